@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// maxDialAttempts bounds how many upstreams a single connection will
+// try before giving up, so that a run of unhealthy upstreams can't
+// turn one client connection into an unbounded dial storm.
+const maxDialAttempts = 3
+
+// upstreamState tracks the live state of one configured upstream: its
+// static spec, how many connections it currently serves, and whether
+// the background health checker currently considers it reachable.
+type upstreamState struct {
+	spec    upstreamSpec
+	conns   atomic.Int64
+	healthy atomic.Bool
+}
+
+// balancer picks an upstream for each new connection according to
+// c.LBPolicy, tracks in-flight connection counts to enforce
+// max_conns and feed least_conn, and runs a background health checker
+// that takes failing upstreams out of rotation until they recover.
+type balancer struct {
+	policy LBPolicy
+	ups    []*upstreamState
+	rr     atomic.Uint64
+}
+
+func newBalancer(specs []upstreamSpec, policy LBPolicy) *balancer {
+	b := &balancer{policy: policy, ups: make([]*upstreamState, len(specs))}
+	for i, s := range specs {
+		st := &upstreamState{spec: s}
+		st.healthy.Store(true)
+		b.ups[i] = st
+	}
+	return b
+}
+
+// candidates returns the upstreams worth trying for a connection
+// identified by key (used only by the ip_hash policy), in the order
+// this policy would pick them, skipping upstreams the health checker
+// has marked unhealthy or that are already at max_conns.
+func (b *balancer) candidates(key string) []*upstreamState {
+	avail := make([]*upstreamState, 0, len(b.ups))
+	for _, u := range b.ups {
+		if !u.healthy.Load() {
+			continue
+		}
+		if u.spec.MaxConns > 0 && u.conns.Load() >= int64(u.spec.MaxConns) {
+			continue
+		}
+		avail = append(avail, u)
+	}
+	if len(avail) == 0 {
+		return nil
+	}
+	switch b.policy {
+	case LBLeastConn:
+		sort.Slice(avail, func(i, j int) bool {
+			return avail[i].conns.Load() < avail[j].conns.Load()
+		})
+	case LBRandom:
+		rand.Shuffle(len(avail), func(i, j int) { avail[i], avail[j] = avail[j], avail[i] })
+	case LBIPHash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		start := int(h.Sum32()) % len(avail)
+		avail = rotate(avail, start)
+	default: // LBRoundRobin
+		weighted := make([]*upstreamState, 0, len(avail))
+		for _, u := range avail {
+			w := u.spec.Weight
+			if w < 1 {
+				w = 1
+			}
+			for i := 0; i < w; i++ {
+				weighted = append(weighted, u)
+			}
+		}
+		n := int(b.rr.Add(1) - 1)
+		avail = rotate(weighted, n%len(weighted))
+	}
+	return avail
+}
+
+// adoptState carries over the in-flight connection count and health
+// status of old for every upstream address that is still present in b,
+// so that a reload which leaves an upstream's address unchanged doesn't
+// reset accounting for the connections it's still serving.
+func (b *balancer) adoptState(old *balancer) {
+	prev := make(map[string]*upstreamState, len(old.ups))
+	for _, u := range old.ups {
+		prev[u.spec.Addr] = u
+	}
+	for _, u := range b.ups {
+		p, ok := prev[u.spec.Addr]
+		if !ok {
+			continue
+		}
+		u.conns.Store(p.conns.Load())
+		u.healthy.Store(p.healthy.Load())
+	}
+}
+
+func rotate(s []*upstreamState, start int) []*upstreamState {
+	rotated := make([]*upstreamState, len(s))
+	n := copy(rotated, s[start:])
+	copy(rotated[n:], s[:start])
+	return rotated
+}
+
+// dial tries, in the order chosen by the load-balancing policy, to
+// connect to one of the available upstreams, up to maxDialAttempts
+// attempts, and returns the connection together with the upstream it
+// picked. The caller is responsible for accounting the connection
+// against the returned upstream's conns counter.
+func (b *balancer) dial(key string) (net.Conn, *upstreamState, error) {
+	candidates := b.candidates(key)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("no healthy upstream available")
+	}
+	if len(candidates) > maxDialAttempts {
+		candidates = candidates[:maxDialAttempts]
+	}
+	var lastErr error
+	for _, u := range candidates {
+		conn, err := net.Dial("tcp", u.spec.Addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, u, nil
+	}
+	return nil, nil, fmt.Errorf("all upstreams failed, last error: %v", lastErr)
+}
+
+// healthCheck TCP-dials every upstream every interval, marking it
+// healthy or unhealthy depending on whether the dial succeeds within
+// timeout. It runs until ctx is done.
+func (b *balancer) healthCheck(ctx context.Context, logger *slog.Logger, interval, timeout time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, u := range b.ups {
+				conn, err := net.DialTimeout("tcp", u.spec.Addr, timeout)
+				healthy := err == nil
+				if conn != nil {
+					conn.Close()
+				}
+				if u.healthy.Swap(healthy) != healthy {
+					if healthy {
+						logger.Info("upstream recovered", "upstream", u.spec.Addr)
+					} else {
+						logger.Warn("upstream marked unhealthy", "upstream", u.spec.Addr, "err", err)
+					}
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"log/syslog"
+	"log/slog"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
 	"gopkg.in/yaml.v3"
 )
 
@@ -62,17 +65,322 @@ func (h *HumanBytes) UnmarshalYAML(node *yaml.Node) error {
 	}
 }
 
+type HumanDuration time.Duration
+
+func (d *HumanDuration) String() string {
+	if d == nil {
+		return time.Duration(0).String()
+	}
+	return time.Duration(*d).String()
+}
+
+func (d *HumanDuration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = HumanDuration(v)
+	return nil
+}
+
+func (d *HumanDuration) UnmarshalYAML(node *yaml.Node) error {
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		return d.Set(v)
+	case int:
+		*d = HumanDuration(time.Duration(v) * time.Second)
+		return nil
+	default:
+		return fmt.Errorf("cannot unmarshal %q into a duration", node.ShortTag())
+	}
+}
+
 type configuration struct {
-	logger    zerolog.Logger
-	Name      string        `yaml:"name" flag:"name,,instance name"`
-	Addrs     StringSlice   `yaml:"addrs" flag:"addrs,127.0.0.1:12000,bind addresses"`
-	Upstream  string        `yaml:"upstream" flag:"upstream,,upstream address"`
-	Rate      HumanBytes    `yaml:"rate" flag:"rate,,incoming traffic rate limit"`
-	Burst     HumanBytes    `yaml:"burst" flag:"burst,,allowed traffic burst"`
-	PerClient bool          `yaml:"per_client" flag:"per-client,,apply rate limit per client"`
-	NoSplice  bool          `yaml:"no_splice" flag:"no-splice,,disable the use of the splice syscall (Linux only)"`
-	BufSize   HumanBytes    `yaml:"buf_size" flag:"buf-size,,buffer size to use to transfer data between the downstream clients and the upstream server"`
-	Logging   loggingConfig `yaml:"logging"`
+	// mu guards the fields below that can be changed live by a
+	// SIGHUP reload: Rate, Burst, PerClient, BufSize, Upstreams,
+	// LBPolicy, Logging and logger. limiter and bufSize are updated
+	// concurrently by in-flight throttledReaders and are therefore
+	// held in atomic values instead.
+	mu                 sync.RWMutex
+	logger             *slog.Logger
+	metrics            *metrics
+	limiter            atomic.Pointer[rate.Limiter]
+	bufSize            atomic.Int64
+	trustedProxies     []*net.IPNet
+	httpTrustedProxies []*net.IPNet
+	clientLimiters     sync.Map // client IP -> *clientLimiter, HTTP mode only
+	balancer           *balancer
+	healthCancel       context.CancelFunc
+	Name               string              `yaml:"name" flag:"name,,instance name"`
+	Addrs              StringSlice         `yaml:"addrs" flag:"addrs,127.0.0.1:12000,bind addresses"`
+	Upstreams          upstreamSpecs       `yaml:"upstreams" flag:"upstreams,,upstream addresses (addr[/weight[/max_conns]], comma-separated)"`
+	LBPolicy           LBPolicy            `yaml:"lb_policy" flag:"lb-policy,round_robin,load balancing policy (round_robin, least_conn, random or ip_hash)"`
+	HealthCheck        healthCheckConfig   `yaml:"health_check"`
+	Mode               string              `yaml:"mode" flag:"mode,tcp,proxy mode (tcp or http)"`
+	Rate               HumanBytes          `yaml:"rate" flag:"rate,,incoming traffic rate limit"`
+	Burst              HumanBytes          `yaml:"burst" flag:"burst,,allowed traffic burst"`
+	PerClient          bool                `yaml:"per_client" flag:"per-client,,apply rate limit per client"`
+	NoSplice           bool                `yaml:"no_splice" flag:"no-splice,,disable the use of the splice syscall (Linux only)"`
+	BufSize            HumanBytes          `yaml:"buf_size" flag:"buf-size,,buffer size to use to transfer data between the downstream clients and the upstream server"`
+	Logging            loggingConfig       `yaml:"logging"`
+	ProxyProtocol      proxyProtocolConfig `yaml:"proxy_protocol"`
+	Metrics            metricsConfig       `yaml:"metrics"`
+	HTTP               httpConfig          `yaml:"http"`
+}
+
+// upstreamSpec describes one upstream in the Upstreams list: its
+// address, an optional weight used by the round_robin policy
+// (defaulting to 1), and an optional cap on the number of connections
+// it will be sent concurrently (0 means unlimited).
+type upstreamSpec struct {
+	Addr     string `yaml:"addr"`
+	Weight   int    `yaml:"weight"`
+	MaxConns int    `yaml:"max_conns"`
+}
+
+// upstreamSpecs is the flag-bindable form of a list of upstreamSpec.
+// Sourced from YAML it decodes as a normal sequence of mappings;
+// sourced from a flag it parses a comma-separated list of
+// addr[/weight[/max_conns]] entries.
+type upstreamSpecs []upstreamSpec
+
+func (u *upstreamSpecs) String() string {
+	if u == nil || len(*u) == 0 {
+		return ""
+	}
+	addrs := make([]string, len(*u))
+	for i, s := range *u {
+		addrs[i] = s.Addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (u *upstreamSpecs) Set(s string) error {
+	parts := strings.Split(s, ",")
+	specs := make(upstreamSpecs, 0, len(parts))
+	for _, p := range parts {
+		spec, err := parseUpstreamSpec(p)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+	}
+	*u = specs
+	return nil
+}
+
+// parseUpstreamSpec parses the addr[/weight[/max_conns]] syntax used
+// by the -upstreams flag.
+func parseUpstreamSpec(s string) (upstreamSpec, error) {
+	fields := strings.Split(strings.TrimSpace(s), "/")
+	if len(fields) > 3 {
+		return upstreamSpec{}, fmt.Errorf("invalid upstream spec %q", s)
+	}
+	spec := upstreamSpec{Addr: fields[0], Weight: 1}
+	if len(fields) > 1 && fields[1] != "" {
+		w, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return upstreamSpec{}, fmt.Errorf("invalid weight in upstream spec %q: %v", s, err)
+		}
+		spec.Weight = w
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		m, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return upstreamSpec{}, fmt.Errorf("invalid max_conns in upstream spec %q: %v", s, err)
+		}
+		spec.MaxConns = m
+	}
+	return spec, nil
+}
+
+// LBPolicy selects how a balancer picks among the configured
+// upstreams for each new connection.
+type LBPolicy string
+
+const (
+	LBRoundRobin LBPolicy = "round_robin"
+	LBLeastConn  LBPolicy = "least_conn"
+	LBRandom     LBPolicy = "random"
+	LBIPHash     LBPolicy = "ip_hash"
+)
+
+func (p *LBPolicy) String() string {
+	if p == nil {
+		return string(LBRoundRobin)
+	}
+	return string(*p)
+}
+
+func (p *LBPolicy) Set(s string) error {
+	switch LBPolicy(s) {
+	case LBRoundRobin, LBLeastConn, LBRandom, LBIPHash:
+		*p = LBPolicy(s)
+		return nil
+	default:
+		return fmt.Errorf("invalid load balancing policy %q", s)
+	}
+}
+
+func (p *LBPolicy) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	return p.Set(s)
+}
+
+type healthCheckConfig struct {
+	Interval HumanDuration `yaml:"interval" flag:"health-check-interval,5s,interval between upstream health checks"`
+	Timeout  HumanDuration `yaml:"timeout" flag:"health-check-timeout,2s,timeout for each upstream health check dial"`
+}
+
+type metricsConfig struct {
+	Addr      string `yaml:"addr" flag:"metrics-addr,,address to expose Prometheus metrics on (empty disables the metrics server)"`
+	PerClient bool   `yaml:"per_client" flag:"metrics-per-client,,expose per-client-IP labelled byte counters (increases cardinality)"`
+}
+
+type httpConfig struct {
+	TrustedProxies    StringSlice   `yaml:"trusted_proxies" flag:"http-trusted-proxies,,CIDR ranges of upstream proxies trusted to report the client IP via X-Real-IP/X-Forwarded-For/Forwarded"`
+	SetForwarded      bool          `yaml:"set_forwarded" flag:"http-set-forwarded,,append the resolved hop to the outgoing X-Forwarded-For header toward the upstream"`
+	ClientIdleTimeout HumanDuration `yaml:"client_idle_timeout" flag:"http-client-idle-timeout,10m,how long a per-client rate limiter is kept after its last use in per_client mode (0 disables eviction)"`
+}
+
+// httpMode reports whether HTTP-aware client IP resolution is active.
+func (c *configuration) httpMode() bool {
+	return c.Mode == "http"
+}
+
+// clientLimiter pairs a client's shared rate limiter with the time it
+// was last handed out, so sweepClientLimiters can tell which clients
+// have gone idle.
+type clientLimiter struct {
+	ref      atomic.Pointer[rate.Limiter]
+	lastUsed atomic.Int64 // unix nano
+}
+
+// clientLimiterRef returns the limiter shared by every connection from
+// client, creating one with the given rate/burst the first time
+// client is seen. It lets multiple HTTP/1.1 connections from the same
+// resolved client IP share a single limiter, instead of each getting
+// its own as plain per-connection PerClient mode does.
+func (c *configuration) clientLimiterRef(client string, rt, burst HumanBytes) *atomic.Pointer[rate.Limiter] {
+	v, _ := c.clientLimiters.LoadOrStore(client, new(clientLimiter))
+	cl := v.(*clientLimiter)
+	cl.ref.CompareAndSwap(nil, rate.NewLimiter(rate.Limit(rt), int(burst)))
+	cl.lastUsed.Store(time.Now().UnixNano())
+	return &cl.ref
+}
+
+// sweepClientLimiters periodically evicts per-client limiters that
+// haven't been handed out again for at least ttl, so that an instance
+// running in mode: http with per_client: true doesn't keep one limiter
+// per distinct client IP for its entire lifetime. A ttl <= 0 disables
+// sweeping. It runs until ctx is done.
+func (c *configuration) sweepClientLimiters(ctx context.Context, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	t := time.NewTicker(ttl)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			cutoff := time.Now().Add(-ttl).UnixNano()
+			c.clientLimiters.Range(func(key, value interface{}) bool {
+				if value.(*clientLimiter).lastUsed.Load() < cutoff {
+					c.clientLimiters.Delete(key)
+				}
+				return true
+			})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type proxyProtocolConfig struct {
+	Mode           ProxyProtocolMode `yaml:"mode" flag:"proxy-protocol,none,PROXY protocol mode (none, accept, send or both)"`
+	Version        int               `yaml:"version" flag:"proxy-protocol-version,1,PROXY protocol version to use when sending a header (1 or 2)"`
+	TrustedProxies StringSlice       `yaml:"trusted_proxies" flag:"proxy-protocol-trusted-proxies,,CIDR ranges of upstream proxies trusted to send a PROXY protocol header"`
+}
+
+// currentLogger returns the logger currently in effect, safe to use
+// concurrently with a SIGHUP reload rebuilding it.
+func (c *configuration) currentLogger() *slog.Logger {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.logger
+}
+
+// currentBalancer returns the balancer currently in effect, safe to
+// use concurrently with a SIGHUP reload rebuilding it.
+func (c *configuration) currentBalancer() *balancer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.balancer
+}
+
+func (p *proxyProtocolConfig) acceptEnabled() bool {
+	return p.Mode == ProxyProtocolAccept || p.Mode == ProxyProtocolBoth
+}
+
+func (p *proxyProtocolConfig) sendEnabled() bool {
+	return p.Mode == ProxyProtocolSend || p.Mode == ProxyProtocolBoth
+}
+
+// ProxyProtocolMode selects whether rlproxy accepts a PROXY protocol
+// header from the connections it receives, sends one to the upstream
+// it connects to, both or neither.
+type ProxyProtocolMode string
+
+const (
+	ProxyProtocolNone   ProxyProtocolMode = "none"
+	ProxyProtocolAccept ProxyProtocolMode = "accept"
+	ProxyProtocolSend   ProxyProtocolMode = "send"
+	ProxyProtocolBoth   ProxyProtocolMode = "both"
+)
+
+func (m *ProxyProtocolMode) String() string {
+	if m == nil {
+		return string(ProxyProtocolNone)
+	}
+	return string(*m)
+}
+
+func (m *ProxyProtocolMode) Set(s string) error {
+	switch ProxyProtocolMode(s) {
+	case ProxyProtocolNone, ProxyProtocolAccept, ProxyProtocolSend, ProxyProtocolBoth:
+		*m = ProxyProtocolMode(s)
+		return nil
+	default:
+		return fmt.Errorf("invalid PROXY protocol mode %q", s)
+	}
+}
+
+func (m *ProxyProtocolMode) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	return m.Set(s)
+}
+
+// parseTrustedProxies parses cidrs as a list of CIDR ranges.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
 
 type loggingConfig struct {
@@ -82,14 +390,16 @@ type loggingConfig struct {
 }
 
 type consoleConfig struct {
-	Enabled   bool `yaml:"enabled" flag:"log-console,true,send log on console"`
-	Pretty    bool `yaml:"pretty" flag:"log-console-pretty,,enable pretty log on console"`
-	UseStderr bool `yaml:"use_stderr" flag:"log-console-stderr,,send logs on stderr"`
+	Enabled   bool   `yaml:"enabled" flag:"log-console,true,send log on console"`
+	Format    string `yaml:"format" flag:"log-console-format,text,console log format (text or json)"`
+	Color     bool   `yaml:"color" flag:"log-console-color,,colorize the text console format when its output is a terminal"`
+	UseStderr bool   `yaml:"use_stderr" flag:"log-console-stderr,,send logs on stderr"`
 }
 
 type syslogConfig struct {
 	Enabled  bool   `yaml:"enabled" flag:"log-syslog,,send log with syslog"`
 	Facility string `yaml:"facility" flag:"log-syslog-facility,local0,syslog facility to use"`
+	Format   string `yaml:"format" flag:"log-syslog-format,cee,syslog message format (cee or rfc5424)"`
 }
 
 func parseConfig(c *configuration, cf string) error {
@@ -105,69 +415,3 @@ func parseConfig(c *configuration, cf string) error {
 	}
 	return nil
 }
-
-var syslogFacilities = map[string]syslog.Priority{
-	"kern":     syslog.LOG_KERN,
-	"user":     syslog.LOG_USER,
-	"mail":     syslog.LOG_MAIL,
-	"daemon":   syslog.LOG_DAEMON,
-	"auth":     syslog.LOG_AUTH,
-	"syslog":   syslog.LOG_SYSLOG,
-	"lpr":      syslog.LOG_LPR,
-	"news":     syslog.LOG_NEWS,
-	"uucp":     syslog.LOG_UUCP,
-	"cron":     syslog.LOG_CRON,
-	"authpriv": syslog.LOG_AUTHPRIV,
-	"ftp":      syslog.LOG_FTP,
-	"local0":   syslog.LOG_LOCAL0,
-	"local1":   syslog.LOG_LOCAL1,
-	"local2":   syslog.LOG_LOCAL2,
-	"local3":   syslog.LOG_LOCAL3,
-	"local4":   syslog.LOG_LOCAL4,
-	"local5":   syslog.LOG_LOCAL5,
-	"local6":   syslog.LOG_LOCAL6,
-	"local7":   syslog.LOG_LOCAL7,
-}
-
-func loggerFromConfig(conf *loggingConfig) (*zerolog.Logger, error) {
-	const app = "rlproxy"
-	level, err := zerolog.ParseLevel(conf.Level)
-	if err != nil {
-		return nil, fmt.Errorf("invalid log level %q: %v", conf.Level, err)
-	}
-	writers := []io.Writer{}
-	if conf.Console.Enabled {
-		conf := conf.Console
-		out := os.Stdout
-		if conf.UseStderr {
-			out = os.Stderr
-		}
-		if conf.Pretty {
-			w := zerolog.NewConsoleWriter()
-			w.Out = out
-			w.TimeFormat = time.RFC3339
-			writers = append(writers, w)
-		} else {
-			writers = append(writers, out)
-		}
-	}
-	if conf.Syslog.Enabled {
-		conf := conf.Syslog
-		facility, ok := syslogFacilities[conf.Facility]
-		if !ok {
-			return nil, fmt.Errorf("unknown syslog facility %q", conf.Facility)
-		}
-		prio := syslog.LOG_INFO | facility
-		w, err := syslog.New(prio, app)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create syslog logger: %v", err)
-		}
-		writers = append(writers, zerolog.SyslogCEEWriter(w))
-	}
-	mw := zerolog.MultiLevelWriter(writers...)
-	logger := zerolog.New(mw).Level(level).With().
-		Timestamp().
-		Str("app", app).
-		Logger()
-	return &logger, nil
-}
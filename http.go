@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// httpConn wraps a connection accepted in HTTP mode. It replays the
+// buffered request line and headers of the first request -- with the
+// X-Forwarded-For header optionally rewritten -- ahead of the
+// underlying stream, and overrides RemoteAddr() with the client IP
+// resolved from the forwarding headers. Unlike proxyHeaderConn, it
+// does not forward SyscallConn: the replayed header bytes can no
+// longer be spliced, so this connection naturally falls out of the
+// splice fast path.
+type httpConn struct {
+	net.Conn
+	r        io.Reader
+	realAddr net.Addr
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *httpConn) RemoteAddr() net.Addr {
+	return c.realAddr
+}
+
+// CloseWrite half-closes the underlying connection's write side, if it
+// supports it, falling back to a full Close otherwise.
+func (c *httpConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// acceptHTTP peeks at the first HTTP request's headers on conn to
+// resolve the real client IP, giving X-Real-IP precedence over the
+// right-most X-Forwarded-For entry that isn't itself one of the
+// trusted proxies, itself preferred over an RFC 7239 Forwarded
+// header. Forwarding headers are only honored if conn's immediate
+// peer is itself trusted; otherwise conn's own remote address is
+// used, same as acceptProxyProtocol. It must be called before any
+// other read on conn.
+func acceptHTTP(conn net.Conn, trusted []*net.IPNet, setForwarded bool) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	requestLine, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP request line: %v", err)
+	}
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read HTTP headers: %v", err)
+	}
+	realAddr := conn.RemoteAddr()
+	if isTrustedProxy(realAddr, trusted) {
+		if ip := clientIPFromHeaders(hdr, trusted); ip != nil {
+			realAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if setForwarded {
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			if prev := hdr.Get("X-Forwarded-For"); prev != "" {
+				hdr.Set("X-Forwarded-For", prev+", "+host)
+			} else {
+				hdr.Set("X-Forwarded-For", host)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\r\n", requestLine)
+	for k, vs := range hdr {
+		for _, v := range vs {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	return &httpConn{
+		Conn:     conn,
+		r:        io.MultiReader(&buf, br),
+		realAddr: realAddr,
+	}, nil
+}
+
+// clientIPFromHeaders resolves the client IP from the forwarding
+// headers of a single request. It returns nil if none of them yield
+// a usable IP.
+func clientIPFromHeaders(hdr textproto.MIMEHeader, trusted []*net.IPNet) net.IP {
+	if v := hdr.Get("X-Real-Ip"); v != "" {
+		if ip := net.ParseIP(v); ip != nil {
+			return ip
+		}
+	}
+	if v := hdr.Get("X-Forwarded-For"); v != "" {
+		if ip := rightmostUntrustedXFF(v, trusted); ip != nil {
+			return ip
+		}
+	}
+	if v := hdr.Get("Forwarded"); v != "" {
+		if ip := forwardedFor(v); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// rightmostUntrustedXFF walks an X-Forwarded-For list from the right,
+// skipping entries that belong to a trusted proxy, and returns the
+// first one that doesn't: the client address as seen by the nearest
+// trusted hop.
+func rightmostUntrustedXFF(v string, trusted []*net.IPNet) net.IP {
+	parts := strings.Split(v, ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(parts[i]))
+		if ip == nil {
+			continue
+		}
+		if !isTrustedProxy(&net.TCPAddr{IP: ip}, trusted) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// forwardedFor extracts the for= parameter from the first element of
+// an RFC 7239 Forwarded header.
+func forwardedFor(v string) net.IP {
+	for _, part := range strings.Split(v, ",") {
+		for _, pair := range strings.Split(part, ";") {
+			k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "for") {
+				continue
+			}
+			val = strings.Trim(strings.TrimSpace(val), `"`)
+			if host, _, err := net.SplitHostPort(val); err == nil {
+				val = host
+			}
+			val = strings.TrimPrefix(val, "[")
+			val = strings.TrimSuffix(val, "]")
+			if ip := net.ParseIP(val); ip != nil {
+				return ip
+			}
+		}
+	}
+	return nil
+}
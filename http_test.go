@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func mustTrusted(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseTrustedProxies(cidrs)
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+	return nets
+}
+
+func TestRightmostUntrustedXFF(t *testing.T) {
+	trusted := mustTrusted(t, "10.0.0.0/8")
+	cases := []struct {
+		name string
+		v    string
+		want string
+	}{
+		{"single untrusted", "203.0.113.1", "203.0.113.1"},
+		{"trailing trusted hop", "203.0.113.1, 10.0.0.1", "203.0.113.1"},
+		{"all trusted", "10.0.0.1, 10.0.0.2", ""},
+		{"garbled rightmost entry falls back", "203.0.113.1, not-an-ip", "203.0.113.1"},
+		{"empty", "", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := rightmostUntrustedXFF(tc.v, trusted)
+			if tc.want == "" {
+				if got != nil {
+					t.Fatalf("got %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tc.want {
+				t.Fatalf("got %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	cases := []struct {
+		name string
+		v    string
+		want string
+	}{
+		{"simple", `for=203.0.113.1`, "203.0.113.1"},
+		{"quoted", `for="203.0.113.1"`, "203.0.113.1"},
+		{"with port", `for="203.0.113.1:1234"`, "203.0.113.1"},
+		{"ipv6 bracketed with port", `for="[2001:db8::1]:1234"`, "2001:db8::1"},
+		{"ipv6 bracketed no port", `for="[2001:db8::1]"`, "2001:db8::1"},
+		{"extra params before for", `proto=http;by=203.0.113.43;for=203.0.113.1`, "203.0.113.1"},
+		{"multiple hops takes first", `for=203.0.113.1, for=198.51.100.1`, "203.0.113.1"},
+		{"no for param", `proto=http`, ""},
+		{"malformed value", `for=not-an-ip`, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := forwardedFor(tc.v)
+			if tc.want == "" {
+				if got != nil {
+					t.Fatalf("got %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tc.want {
+				t.Fatalf("got %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientIPFromHeaders(t *testing.T) {
+	trusted := mustTrusted(t, "10.0.0.0/8")
+	hdr := func(pairs ...string) textproto.MIMEHeader {
+		h := make(textproto.MIMEHeader)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			h.Add(pairs[i], pairs[i+1])
+		}
+		return h
+	}
+	cases := []struct {
+		name string
+		hdr  textproto.MIMEHeader
+		want string
+	}{
+		{
+			name: "X-Real-IP wins over XFF and Forwarded",
+			hdr: hdr(
+				"X-Real-Ip", "203.0.113.9",
+				"X-Forwarded-For", "203.0.113.1",
+				"Forwarded", "for=203.0.113.2",
+			),
+			want: "203.0.113.9",
+		},
+		{
+			name: "XFF wins over Forwarded when no X-Real-IP",
+			hdr: hdr(
+				"X-Forwarded-For", "203.0.113.1",
+				"Forwarded", "for=203.0.113.2",
+			),
+			want: "203.0.113.1",
+		},
+		{
+			name: "malformed X-Real-IP falls back to XFF",
+			hdr: hdr(
+				"X-Real-Ip", "not-an-ip",
+				"X-Forwarded-For", "203.0.113.1",
+			),
+			want: "203.0.113.1",
+		},
+		{
+			name: "falls back to Forwarded",
+			hdr: hdr(
+				"Forwarded", "for=203.0.113.2",
+			),
+			want: "203.0.113.2",
+		},
+		{
+			name: "no usable header",
+			hdr:  hdr(),
+			want: "",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := clientIPFromHeaders(tc.hdr, trusted)
+			if tc.want == "" {
+				if got != nil {
+					t.Fatalf("got %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tc.want {
+				t.Fatalf("got %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
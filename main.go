@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
@@ -15,7 +16,6 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/montag451/go-sflag"
-	"github.com/rs/zerolog"
 	"golang.org/x/time/rate"
 )
 
@@ -23,55 +23,117 @@ var Version = "unknown"
 
 var globalCounter atomic.Uint64
 
-func handleClient(c *configuration, conn net.Conn, limiter *rate.Limiter) {
+func handleClient(c *configuration, conn net.Conn, limiterRef *atomic.Pointer[rate.Limiter]) {
 	defer conn.Close()
-	logger := c.logger.With().Stringer("client", conn.RemoteAddr()).Logger()
-	defer logger.Debug().Msg("stop proxying client")
-	logger.Debug().Msg("new client")
-	uconn, err := net.Dial("tcp", c.Upstream)
+	c.metrics.connectionsTotal.Inc()
+	c.metrics.activeConnections.Inc()
+	defer c.metrics.activeConnections.Dec()
+	start := time.Now()
+	defer func() {
+		c.metrics.connDuration.Observe(time.Since(start).Seconds())
+	}()
+	if c.ProxyProtocol.acceptEnabled() {
+		pconn, err := acceptProxyProtocol(conn, c.trustedProxies)
+		if err != nil {
+			c.currentLogger().Error("invalid PROXY protocol header", "client", conn.RemoteAddr(), "err", err)
+			return
+		}
+		conn = pconn
+	}
+	if c.httpMode() {
+		hconn, err := acceptHTTP(conn, c.httpTrustedProxies, c.HTTP.SetForwarded)
+		if err != nil {
+			c.currentLogger().Error("invalid HTTP request", "client", conn.RemoteAddr(), "err", err)
+			return
+		}
+		conn = hconn
+		c.mu.RLock()
+		rt, burst, perClient := c.Rate, c.Burst, c.PerClient
+		c.mu.RUnlock()
+		if rt > 0 && perClient {
+			limiterRef = c.clientLimiterRef(clientHost(conn.RemoteAddr()), rt, burst)
+		}
+	}
+	client := clientHost(conn.RemoteAddr())
+	logger := c.currentLogger().With("client", conn.RemoteAddr())
+	defer logger.Debug("stop proxying client")
+	logger.Debug("new client")
+	uconn, ups, err := c.currentBalancer().dial(client)
 	if err != nil {
-		logger.Err(err).Msg("failed to connect to upstream")
+		c.metrics.dialErrorsTotal.Inc()
+		logger.Error("failed to connect to upstream", "err", err)
 		return
 	}
 	defer uconn.Close()
+	upstream := ups.spec.Addr
+	ups.conns.Add(1)
+	defer ups.conns.Add(-1)
+	logger = logger.With("upstream", upstream)
+	if c.ProxyProtocol.sendEnabled() {
+		if err := sendProxyHeader(uconn, conn.RemoteAddr(), conn.LocalAddr(), c.ProxyProtocol.Version); err != nil {
+			logger.Error("failed to send PROXY protocol header to upstream", "err", err)
+			return
+		}
+	}
 	var wg sync.WaitGroup
-	forward := func(from, to net.Conn, limit bool) {
+	forward := func(from, to net.Conn, direction string, limiterRef *atomic.Pointer[rate.Limiter]) {
 		defer wg.Done()
-		defer to.(*net.TCPConn).CloseWrite()
-		logger := logger.With().
-			Stringer("from", from.RemoteAddr()).
-			Stringer("to", to.RemoteAddr()).
-			Logger()
-		logger.Debug().Msg("forward start")
-		defer logger.Debug().Msg("forward done")
+		defer closeWrite(to)
+		logger := logger.With(
+			"from", from.RemoteAddr(),
+			"to", to.RemoteAddr(),
+		)
+		logger.Debug("forward start")
+		defer logger.Debug("forward done")
+		var clientCounter atomic.Uint64
+		progress := func(n int) {
+			clientCounter.Add(uint64(n))
+			globalCounter.Add(uint64(n))
+			c.metrics.addBytes(direction, upstream, client, uint64(n))
+		}
 		var r *throttledReader
-		bs := int64(c.BufSize)
-		if limit {
+		if limiterRef != nil {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			var clientCounter atomic.Uint64
-			progress := func(n int) {
-				clientCounter.Add(uint64(n))
-				globalCounter.Add(uint64(n))
-			}
-			r = newThrottledReader(from, limiter, bs, c.NoSplice, progress)
-			go logRate(ctx, &logger, &clientCounter, 5*time.Second)
+			r = newThrottledReader(from, limiterRef, &c.bufSize, c.NoSplice, progress)
+			go logRate(ctx, func() *slog.Logger { return logger }, &clientCounter, 5*time.Second)
 		} else {
-			r = newThrottledReader(from, nil, bs, c.NoSplice, nil)
+			r = newThrottledReader(from, new(atomic.Pointer[rate.Limiter]), &c.bufSize, c.NoSplice, progress)
 		}
 		n, err := r.WriteTo(to)
-		logger.Debug().Msgf("%d bytes sent", n)
+		logger.Debug(fmt.Sprintf("%d bytes sent", n))
 		if err != nil {
-			logger.Err(err).Msg("forward error")
+			logger.Error("forward error", "err", err)
 		}
 	}
 	wg.Add(2)
-	go forward(conn, uconn, true)
-	go forward(uconn, conn, false)
+	go forward(conn, uconn, "tx", limiterRef)
+	go forward(uconn, conn, "rx", nil)
 	wg.Wait()
 }
 
-func logRate(ctx context.Context, l *zerolog.Logger, c *atomic.Uint64, interval time.Duration) {
+// closeWriter is implemented by connections that can half-close their
+// write side, such as *net.TCPConn and the accept-mode wrappers in
+// proxyprotocol.go and http.go.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes conn's write side so the peer sees EOF while
+// the other direction of the proxied connection keeps running, falling
+// back to a full Close if conn doesn't support it.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// logRate logs the throughput accumulated in c every interval, fetching
+// the logger to use from loggerFunc on each tick so that a logger
+// swapped in by a later SIGHUP reload takes effect immediately.
+func logRate(ctx context.Context, loggerFunc func() *slog.Logger, c *atomic.Uint64, interval time.Duration) {
 	var prev uint64
 	t := time.NewTicker(interval)
 	defer t.Stop()
@@ -80,10 +142,11 @@ func logRate(ctx context.Context, l *zerolog.Logger, c *atomic.Uint64, interval
 		case <-t.C:
 			cur := c.Load()
 			rate := float64((cur-prev)*8) / interval.Seconds()
-			l.Info().
-				Float64("rate", rate).
-				Str("rate_human", humanize.SI(rate/8, "B")).
-				Msgf("rate: %.1f bps", rate)
+			loggerFunc().Info(
+				fmt.Sprintf("rate: %.1f bps", rate),
+				"rate", rate,
+				"rate_human", humanize.SI(rate/8, "B"),
+			)
 			prev = cur
 		case <-ctx.Done():
 			return
@@ -96,7 +159,7 @@ func main() {
 	var c configuration
 	cf := flag.String("config", "", "configuration file")
 	showVersion := flag.Bool("version", false, "show version")
-	sflag.AddFlags(flag.CommandLine, c)
+	sflag.AddFlags(flag.CommandLine, &c)
 	flag.Parse()
 	if *showVersion {
 		fmt.Println(Version)
@@ -113,62 +176,69 @@ func main() {
 	if err != nil {
 		log.Panicf("failed to create logger: %v", err)
 	}
-	c.logger = logger.With().
-		Str("instance", c.Name).
-		Str("upstream", c.Upstream).
-		Logger()
-	if len(c.Addrs) == 0 || c.Upstream == "" {
+	c.logger = logger.With("instance", c.Name)
+	if len(c.Addrs) == 0 || len(c.Upstreams) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 	if c.Burst == 0 {
 		c.Burst = c.Rate
 	}
-	var limiter *rate.Limiter
+	trustedProxies, err := parseTrustedProxies(c.ProxyProtocol.TrustedProxies)
+	if err != nil {
+		log.Panicf("invalid config: %v", err)
+	}
+	c.trustedProxies = trustedProxies
+	if c.ProxyProtocol.sendEnabled() && c.ProxyProtocol.Version != 1 && c.ProxyProtocol.Version != 2 {
+		log.Panicf("invalid proxy_protocol_version %d: must be 1 or 2", c.ProxyProtocol.Version)
+	}
+	httpTrustedProxies, err := parseTrustedProxies(c.HTTP.TrustedProxies)
+	if err != nil {
+		log.Panicf("invalid config: %v", err)
+	}
+	c.httpTrustedProxies = httpTrustedProxies
+	if c.Mode != "tcp" && c.Mode != "http" {
+		log.Panicf("invalid mode %q: must be tcp or http", c.Mode)
+	}
 	if c.Rate > 0 {
-		limiter = rate.NewLimiter(rate.Limit(c.Rate), int(c.Burst))
+		c.limiter.Store(rate.NewLimiter(rate.Limit(c.Rate), int(c.Burst)))
 	}
+	c.bufSize.Store(int64(c.BufSize))
+	c.metrics = newMetrics(&c.Metrics, c.Name)
+	c.metrics.setLimits(float64(c.Rate), float64(c.Burst))
+	c.balancer = newBalancer(c.Upstreams, c.LBPolicy)
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	listeners := make([]*net.TCPListener, len(c.Addrs))
-	defer func() {
-		for _, l := range listeners {
-			l.Close()
-		}
-	}()
 	var wg sync.WaitGroup
-	for i, addr := range c.Addrs {
-		l, err := net.Listen("tcp", addr)
-		if err != nil {
-			logger.Panic().Err(err).Msgf("failed to listen on %q", addr)
-		}
-		listeners[i] = l.(*net.TCPListener)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				conn, err := l.Accept()
-				if err != nil {
-					if !os.IsTimeout(err) {
-						logger.Panic().Err(err).Msg("failed to accept new connection")
-					}
-					break
-				}
-				limiter := limiter
-				if c.Rate > 0 && c.PerClient {
-					limiter = rate.NewLimiter(rate.Limit(c.Rate), int(c.Burst))
-				}
-				go handleClient(&c, conn, limiter)
-			}
-		}()
+	ls := newListenerSet(&c, &wg)
+	ls.sync(c.Addrs, true)
+	go logRate(ctx, c.currentLogger, &globalCounter, 5*time.Second)
+	if c.Metrics.Addr != "" {
+		go c.metrics.serve(ctx, c.logger, c.Metrics.Addr)
 	}
-	go logRate(ctx, &c.logger, &globalCounter, 5*time.Second)
-	sig := <-sigCh
-	logger.Info().Msgf("signal %s received, exiting", sig)
-	for _, l := range listeners {
-		l.SetDeadline(time.Now())
+	healthCtx, healthCancel := context.WithCancel(ctx)
+	c.healthCancel = healthCancel
+	go c.balancer.healthCheck(healthCtx, c.logger, time.Duration(c.HealthCheck.Interval), time.Duration(c.HealthCheck.Timeout))
+	if c.httpMode() {
+		go c.sweepClientLimiters(ctx, time.Duration(c.HTTP.ClientIdleTimeout))
+	}
+	for {
+		select {
+		case sig := <-sigCh:
+			c.currentLogger().Info(fmt.Sprintf("signal %s received, exiting", sig))
+			ls.closeAll()
+			wg.Wait()
+			return
+		case <-hupCh:
+			if *cf == "" {
+				c.currentLogger().Warn("SIGHUP received but no config file was given on the command line, ignoring")
+				continue
+			}
+			reload(ctx, &c, *cf, ls)
+		}
 	}
-	wg.Wait()
 }
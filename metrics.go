@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors rlproxy feeds while proxying
+// connections. It is created once per instance and registered against a
+// private registry so that the exposed series are exactly the ones
+// listed below, not whatever else happens to be linked in.
+type metrics struct {
+	instance          string
+	perClient         bool
+	registry          *prometheus.Registry
+	bytesTotal        *prometheus.CounterVec
+	clientBytesTotal  *prometheus.CounterVec
+	connectionsTotal  prometheus.Counter
+	activeConnections prometheus.Gauge
+	dialErrorsTotal   prometheus.Counter
+	connDuration      prometheus.Histogram
+	rateLimit         prometheus.Gauge
+	rateBurst         prometheus.Gauge
+}
+
+func newMetrics(conf *metricsConfig, instance string) *metrics {
+	m := &metrics{
+		instance:  instance,
+		perClient: conf.PerClient,
+		registry:  prometheus.NewRegistry(),
+		bytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rlproxy_bytes_total",
+			Help: "Total bytes forwarded, by direction and upstream.",
+		}, []string{"direction", "instance", "upstream"}),
+		clientBytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rlproxy_client_bytes_total",
+			Help: "Total bytes forwarded, by direction and client IP.",
+		}, []string{"direction", "instance", "client"}),
+		connectionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "rlproxy_connections_total",
+			Help:        "Total number of client connections accepted.",
+			ConstLabels: prometheus.Labels{"instance": instance},
+		}),
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "rlproxy_active_connections",
+			Help:        "Number of client connections currently being proxied.",
+			ConstLabels: prometheus.Labels{"instance": instance},
+		}),
+		dialErrorsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "rlproxy_upstream_dial_errors_total",
+			Help:        "Total number of failed dial attempts to the upstream.",
+			ConstLabels: prometheus.Labels{"instance": instance},
+		}),
+		connDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "rlproxy_connection_duration_seconds",
+			Help:        "Duration of proxied connections.",
+			ConstLabels: prometheus.Labels{"instance": instance},
+			Buckets:     prometheus.DefBuckets,
+		}),
+		rateLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "rlproxy_rate_limit_bytes",
+			Help:        "Currently configured rate limit, in bytes per second (0 means unlimited).",
+			ConstLabels: prometheus.Labels{"instance": instance},
+		}),
+		rateBurst: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "rlproxy_rate_burst_bytes",
+			Help:        "Currently configured rate burst, in bytes.",
+			ConstLabels: prometheus.Labels{"instance": instance},
+		}),
+	}
+	m.registry.MustRegister(
+		m.bytesTotal,
+		m.clientBytesTotal,
+		m.connectionsTotal,
+		m.activeConnections,
+		m.dialErrorsTotal,
+		m.connDuration,
+		m.rateLimit,
+		m.rateBurst,
+	)
+	return m
+}
+
+// addBytes records n bytes forwarded in direction (one of "tx" for
+// client-to-upstream or "rx" for upstream-to-client) toward upstream,
+// and, when per-client metrics are enabled, toward client as well.
+func (m *metrics) addBytes(direction, upstream, client string, n uint64) {
+	if n == 0 {
+		return
+	}
+	m.bytesTotal.WithLabelValues(direction, m.instance, upstream).Add(float64(n))
+	if m.perClient {
+		m.clientBytesTotal.WithLabelValues(direction, m.instance, client).Add(float64(n))
+	}
+}
+
+func (m *metrics) setLimits(rate, burst float64) {
+	m.rateLimit.Set(rate)
+	m.rateBurst.Set(burst)
+}
+
+// serve starts the embedded Prometheus metrics HTTP server on addr. It
+// blocks until the server stops, which only happens on a listen error
+// since the metrics endpoint must not interfere with the proxy's own
+// lifecycle.
+func (m *metrics) serve(ctx context.Context, logger *slog.Logger, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error(fmt.Sprintf("metrics server on %q failed", addr), "err", err)
+	}
+}
+
+// clientHost returns the IP part of addr, or addr's full string if it
+// doesn't carry a port, for use as the low-cardinality "client" label.
+func clientHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
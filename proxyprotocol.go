@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxProxyV1HeaderLen is the maximum length (including the trailing
+// CRLF) of a PROXY protocol v1 header, as mandated by the spec.
+const maxProxyV1HeaderLen = 107
+
+// proxyV2Sig is the 12-byte signature that prefixes every PROXY
+// protocol v2 header.
+var proxyV2Sig = [12]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamProtoTCP4 = 0x11
+	proxyV2FamProtoTCP6 = 0x21
+)
+
+// proxyHeaderConn wraps a net.Conn accepted behind a PROXY protocol
+// header, overriding RemoteAddr() with the address carried by the
+// header. SyscallConn is forwarded to the wrapped connection so that
+// it keeps satisfying splice.FD, allowing the splice fast path to
+// survive header parsing.
+type proxyHeaderConn struct {
+	net.Conn
+	realAddr net.Addr
+}
+
+func (c *proxyHeaderConn) RemoteAddr() net.Addr {
+	return c.realAddr
+}
+
+func (c *proxyHeaderConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("underlying connection does not support raw access")
+	}
+	return sc.SyscallConn()
+}
+
+// CloseWrite half-closes the underlying connection's write side, if it
+// supports it, falling back to a full Close otherwise.
+func (c *proxyHeaderConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// isTrustedProxy reports whether addr belongs to one of the trusted
+// CIDR ranges. An empty list trusts every source.
+func isTrustedProxy(addr net.Addr, trusted []*net.IPNet) bool {
+	if len(trusted) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxyProtocol reads and parses a PROXY protocol header off
+// conn if conn's remote address is trusted, and returns a connection
+// whose RemoteAddr() reflects the real client address carried by the
+// header. It must be called before any other read on conn.
+func acceptProxyProtocol(conn net.Conn, trusted []*net.IPNet) (net.Conn, error) {
+	if !isTrustedProxy(conn.RemoteAddr(), trusted) {
+		return conn, nil
+	}
+	addr, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &proxyHeaderConn{Conn: conn, realAddr: addr}, nil
+}
+
+func readProxyHeader(conn net.Conn) (net.Addr, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+	if b[0] == proxyV2Sig[0] {
+		return readProxyHeaderV2(conn, b[0])
+	}
+	return readProxyHeaderV1(conn, b[0])
+}
+
+// readProxyHeaderV1 reads a v1 text header one byte at a time, since
+// the header is not length-prefixed and conn must not be wrapped in a
+// buffered reader (that would make splice miss bytes). first is the
+// byte already consumed by the caller while detecting the version.
+func readProxyHeaderV1(conn net.Conn, first byte) (net.Addr, error) {
+	buf := make([]byte, 1, maxProxyV1HeaderLen)
+	buf[0] = first
+	var b [1]byte
+	for {
+		if len(buf) >= maxProxyV1HeaderLen {
+			return nil, fmt.Errorf("PROXY protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol v1 header: %v", err)
+		}
+		buf = append(buf, b[0])
+		if len(buf) >= 2 && buf[len(buf)-2] == '\r' && buf[len(buf)-1] == '\n' {
+			break
+		}
+	}
+	line := string(buf[:len(buf)-2])
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	srcIP := net.ParseIP(fields[2])
+	srcPort, err := strconv.Atoi(fields[4])
+	if srcIP == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+// readProxyHeaderV2 reads a v2 binary header. first is the signature
+// byte already consumed by the caller while detecting the version.
+func readProxyHeaderV2(conn net.Conn, first byte) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	hdr[0] = first
+	if _, err := io.ReadFull(conn, hdr[1:]); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 header: %v", err)
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig[:]) {
+		return nil, fmt.Errorf("invalid PROXY protocol v2 signature")
+	}
+	verCmd := hdr[12]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 version %d", verCmd>>4)
+	}
+	cmd := verCmd & 0x0F
+	famProto := hdr[13]
+	length := int(hdr[14])<<8 | int(hdr[15])
+	body := make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol v2 address block: %v", err)
+		}
+	}
+	if cmd == proxyV2CmdLocal {
+		return nil, nil
+	}
+	if cmd != proxyV2CmdProxy {
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command 0x%x", cmd)
+	}
+	switch famProto {
+	case proxyV2FamProtoTCP4:
+		if length < 12 {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 IPv4 address block")
+		}
+		port := int(body[8])<<8 | int(body[9])
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: port}, nil
+	case proxyV2FamProtoTCP6:
+		if length < 36 {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 IPv6 address block")
+		}
+		port := int(body[32])<<8 | int(body[33])
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: port}, nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 address family/protocol 0x%02x", famProto)
+	}
+}
+
+// sendProxyHeader writes a PROXY protocol header of the given version
+// to w, advertising src as the client address and dst as the address
+// it originally connected to. It must be called before any other
+// write to w so that the header precedes the proxied data.
+func sendProxyHeader(w io.Writer, src, dst net.Addr, version int) error {
+	srcAddr, ok := src.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("PROXY protocol requires a TCP source address, got %T", src)
+	}
+	dstAddr, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("PROXY protocol requires a TCP destination address, got %T", dst)
+	}
+	switch version {
+	case 1:
+		return writeProxyHeaderV1(w, srcAddr, dstAddr)
+	case 2:
+		return writeProxyHeaderV2(w, srcAddr, dstAddr)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
+
+func writeProxyHeaderV1(w io.Writer, src, dst *net.TCPAddr) error {
+	proto := "TCP4"
+	if src.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port)
+	return err
+}
+
+func writeProxyHeaderV2(w io.Writer, src, dst *net.TCPAddr) error {
+	var body []byte
+	famProto := byte(proxyV2FamProtoTCP4)
+	if ip4 := src.IP.To4(); ip4 != nil {
+		body = make([]byte, 12)
+		copy(body[0:4], ip4)
+		copy(body[4:8], dst.IP.To4())
+		body[8], body[9] = byte(src.Port>>8), byte(src.Port)
+		body[10], body[11] = byte(dst.Port>>8), byte(dst.Port)
+	} else {
+		famProto = proxyV2FamProtoTCP6
+		body = make([]byte, 36)
+		copy(body[0:16], src.IP.To16())
+		copy(body[16:32], dst.IP.To16())
+		body[32], body[33] = byte(src.Port>>8), byte(src.Port)
+		body[34], body[35] = byte(dst.Port>>8), byte(dst.Port)
+	}
+	hdr := make([]byte, 0, 16+len(body))
+	hdr = append(hdr, proxyV2Sig[:]...)
+	hdr = append(hdr, 0x21, famProto, byte(len(body)>>8), byte(len(body)))
+	hdr = append(hdr, body...)
+	_, err := w.Write(hdr)
+	return err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// readHeader feeds data to readProxyHeader over a net.Pipe, exercising
+// the real byte-at-a-time v1 reader and the fixed-size v2 reader the
+// same way a real connection would.
+func readHeader(data []byte) (net.Addr, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	addr, err := readProxyHeader(server)
+	server.Close()
+	return addr, err
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	cases := []struct {
+		name    string
+		header  string
+		wantIP  string
+		wantPrt int
+		wantNil bool
+		wantErr bool
+	}{
+		{
+			name:    "valid TCP4",
+			header:  "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+			wantIP:  "192.168.0.1",
+			wantPrt: 56324,
+		},
+		{
+			name:    "valid TCP6",
+			header:  "PROXY TCP6 ::1 ::1 1 2\r\n",
+			wantIP:  "::1",
+			wantPrt: 1,
+		},
+		{
+			name:    "unknown",
+			header:  "PROXY UNKNOWN\r\n",
+			wantNil: true,
+		},
+		{
+			name:    "missing fields",
+			header:  "PROXY TCP4 1.2.3.4\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "not a PROXY header",
+			header:  "GARBAGE TCP4 1.2.3.4 1.2.3.5 1 2\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad source IP",
+			header:  "PROXY TCP4 bogus 1.2.3.4 1 2\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad source port",
+			header:  "PROXY TCP4 1.2.3.4 1.2.3.5 bogus 2\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "too long",
+			header:  "PROXY TCP4 " + string(bytes.Repeat([]byte("1"), maxProxyV1HeaderLen)) + " 1.2.3.5 1 2\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := readHeader([]byte(tc.header))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got addr %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.wantNil {
+				if addr != nil {
+					t.Fatalf("expected a nil address, got %v", addr)
+				}
+				return
+			}
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("expected a *net.TCPAddr, got %T", addr)
+			}
+			if tcpAddr.IP.String() != tc.wantIP || tcpAddr.Port != tc.wantPrt {
+				t.Fatalf("got %s:%d, want %s:%d", tcpAddr.IP, tcpAddr.Port, tc.wantIP, tc.wantPrt)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("::2"), Port: 2}
+
+	encode := func(src, dst *net.TCPAddr) []byte {
+		var buf bytes.Buffer
+		if err := writeProxyHeaderV2(&buf, src, dst); err != nil {
+			t.Fatalf("writeProxyHeaderV2: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("valid TCP4", func(t *testing.T) {
+		addr, err := readHeader(encode(v4src, v4dst))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || !tcpAddr.IP.Equal(v4src.IP) || tcpAddr.Port != v4src.Port {
+			t.Fatalf("got %v, want %v", addr, v4src)
+		}
+	})
+
+	t.Run("valid TCP6", func(t *testing.T) {
+		addr, err := readHeader(encode(v6src, v6dst))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || !tcpAddr.IP.Equal(v6src.IP) || tcpAddr.Port != v6src.Port {
+			t.Fatalf("got %v, want %v", addr, v6src)
+		}
+	})
+
+	t.Run("LOCAL command", func(t *testing.T) {
+		data := encode(v4src, v4dst)
+		data[12] = 0x20 // version 2, command LOCAL
+		addr, err := readHeader(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if addr != nil {
+			t.Fatalf("expected a nil address, got %v", addr)
+		}
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		data := encode(v4src, v4dst)
+		data[11] = 0xFF
+		if _, err := readHeader(data); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		data := encode(v4src, v4dst)
+		data[12] = 0x11 // version 1, command PROXY
+		if _, err := readHeader(data); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("unsupported command", func(t *testing.T) {
+		data := encode(v4src, v4dst)
+		data[12] = 0x22 // version 2, command 0x2
+		if _, err := readHeader(data); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("truncated IPv4 address block", func(t *testing.T) {
+		data := encode(v4src, v4dst)
+		data[15] = 4 // claim a 4-byte address block instead of 12
+		data = data[:16+4]
+		if _, err := readHeader(data); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("unsupported address family", func(t *testing.T) {
+		data := encode(v4src, v4dst)
+		data[13] = 0x00 // UNSPEC family/proto
+		if _, err := readHeader(data); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
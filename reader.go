@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"io"
+	"sync/atomic"
 
 	"golang.org/x/time/rate"
 )
@@ -19,17 +20,17 @@ type progressHandler func(int)
 
 type throttledReader struct {
 	r        io.Reader
-	l        *rate.Limiter
-	bs       int64
+	limiter  *atomic.Pointer[rate.Limiter]
+	bufSize  *atomic.Int64
 	noSplice bool
 	progress progressHandler
 }
 
-func newThrottledReader(r io.Reader, l *rate.Limiter, bs int64, noSplice bool, h progressHandler) *throttledReader {
+func newThrottledReader(r io.Reader, limiter *atomic.Pointer[rate.Limiter], bufSize *atomic.Int64, noSplice bool, h progressHandler) *throttledReader {
 	return &throttledReader{
 		r:        r,
-		l:        l,
-		bs:       bs,
+		limiter:  limiter,
+		bufSize:  bufSize,
 		noSplice: noSplice,
 		progress: h,
 	}
@@ -42,15 +43,15 @@ func (r *throttledReader) Read(buf []byte) (int, error) {
 }
 
 func (r *throttledReader) throttle(n int) {
-	if r.l != nil && n > 0 {
-		b := r.l.Burst()
+	if l := r.limiter.Load(); l != nil && n > 0 {
+		b := l.Burst()
 		rem := n
 		for rem > 0 {
 			wait := b
 			if rem <= b {
 				wait = rem
 			}
-			_ = r.l.WaitN(context.TODO(), wait)
+			_ = l.WaitN(context.TODO(), wait)
 			rem -= wait
 		}
 	}
@@ -60,13 +61,14 @@ func (r *throttledReader) throttle(n int) {
 }
 
 func (r *throttledReader) writeTo(w io.Writer) (int64, error) {
+	bs := r.bufSize.Load()
 	var dst io.Writer = w
-	if r.noSplice || r.bs > 0 {
+	if r.noSplice || bs > 0 {
 		dst = writerOnly{w}
 	}
 	var buf []byte
-	if r.bs > 0 {
-		buf = make([]byte, r.bs)
+	if bs > 0 {
+		buf = make([]byte, bs)
 	}
 	return io.CopyBuffer(dst, readerOnly{r}, buf)
 }
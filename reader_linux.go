@@ -14,22 +14,24 @@ func (r *throttledReader) WriteTo(w io.Writer) (int64, error) {
 		return r.writeTo(w)
 	}
 	progress := func(n int64) {
-		if r.l != nil && n > 0 {
-			b := r.l.Burst()
+		if l := r.limiter.Load(); l != nil && n > 0 {
+			b := l.Burst()
 			rem := int(n)
 			for rem > 0 {
 				wait := b
 				if rem <= b {
 					wait = rem
 				}
-				_ = r.l.WaitN(context.TODO(), wait)
+				_ = l.WaitN(context.TODO(), wait)
 				rem -= wait
 			}
 		}
-		counter.Add(uint64(n))
+		if r.progress != nil {
+			r.progress(int(n))
+		}
 	}
 	opts := []splice.Option{
-		splice.WithBufSize(int(r.bs)),
+		splice.WithBufSize(int(r.bufSize.Load())),
 		splice.WithProgressHandler(progress),
 	}
 	return splice.Copy(dst, src, opts...)
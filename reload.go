@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/montag451/go-sflag"
+	"golang.org/x/time/rate"
+)
+
+// listenerSet tracks the active listeners keyed by bind address, so
+// that a SIGHUP reload can open newly added addresses and close
+// removed ones without disturbing the connections already served by
+// the others.
+type listenerSet struct {
+	c  *configuration
+	wg *sync.WaitGroup
+	ls map[string]*net.TCPListener
+}
+
+func newListenerSet(c *configuration, wg *sync.WaitGroup) *listenerSet {
+	return &listenerSet{c: c, wg: wg, ls: make(map[string]*net.TCPListener)}
+}
+
+// sync opens a listener for every address in addrs that isn't already
+// listened on, and closes the ones that are no longer present. When
+// fatal is true (initial startup), a listen failure is fatal, like
+// before reload support was added; during a reload it is only logged,
+// leaving the rest of the listener set untouched.
+func (s *listenerSet) sync(addrs []string, fatal bool) {
+	want := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		want[addr] = true
+		if _, ok := s.ls[addr]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger := s.c.currentLogger()
+			if fatal {
+				logger.Error(fmt.Sprintf("failed to listen on %q", addr), "err", err)
+				panic(err)
+			}
+			logger.Error(fmt.Sprintf("failed to listen on %q, leaving it out of rotation", addr), "err", err)
+			continue
+		}
+		tl := l.(*net.TCPListener)
+		s.ls[addr] = tl
+		s.wg.Add(1)
+		go serve(s.c, tl, s.wg)
+	}
+	for addr, l := range s.ls {
+		if want[addr] {
+			continue
+		}
+		s.c.currentLogger().Info(fmt.Sprintf("closing listener on %q", addr))
+		l.SetDeadline(time.Now())
+		delete(s.ls, addr)
+	}
+}
+
+// closeAll triggers the shutdown of every listener in the set.
+func (s *listenerSet) closeAll() {
+	for _, l := range s.ls {
+		l.SetDeadline(time.Now())
+	}
+}
+
+// serve accepts connections on l until it's closed, dispatching each
+// one to handleClient with the limiter appropriate for the current
+// configuration.
+func serve(c *configuration, l *net.TCPListener, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !os.IsTimeout(err) {
+				c.currentLogger().Error("failed to accept new connection", "err", err)
+				panic(err)
+			}
+			return
+		}
+		c.mu.RLock()
+		rt, burst, perClient := c.Rate, c.Burst, c.PerClient
+		c.mu.RUnlock()
+		limiterRef := &c.limiter
+		if rt > 0 && perClient {
+			if c.httpMode() {
+				// Resolved once the real client IP is known, inside
+				// handleClient.
+				limiterRef = nil
+			} else {
+				limiterRef = new(atomic.Pointer[rate.Limiter])
+				limiterRef.Store(rate.NewLimiter(rate.Limit(rt), int(burst)))
+			}
+		}
+		go handleClient(c, conn, limiterRef)
+	}
+}
+
+// reload re-reads cf and applies the subset of settings that can be
+// changed without dropping active connections: Rate, Burst, PerClient,
+// BufSize, Upstreams, LBPolicy, HealthCheck, logging and the set of
+// listen addresses.
+func reload(ctx context.Context, c *configuration, cf string, ls *listenerSet) {
+	logger := c.currentLogger()
+	var nc configuration
+	if err := parseConfig(&nc, cf); err != nil {
+		logger.Error("failed to reload config, keeping current configuration", "err", err)
+		return
+	}
+	sflag.SetFromFlags(&nc, flag.CommandLine)
+	newLogger, loggerErr := loggerFromConfig(&nc.Logging)
+	newBalancer := newBalancer(nc.Upstreams, nc.LBPolicy)
+	newBalancer.adoptState(c.currentBalancer())
+	healthCtx, healthCancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.Rate = nc.Rate
+	c.Burst = nc.Burst
+	if c.Burst == 0 {
+		c.Burst = c.Rate
+	}
+	c.PerClient = nc.PerClient
+	c.BufSize = nc.BufSize
+	c.Upstreams = nc.Upstreams
+	c.LBPolicy = nc.LBPolicy
+	c.HealthCheck = nc.HealthCheck
+	c.balancer = newBalancer
+	oldHealthCancel := c.healthCancel
+	c.healthCancel = healthCancel
+	if loggerErr != nil {
+		logger.Error("failed to rebuild logger from reloaded config, keeping current one", "err", loggerErr)
+	} else {
+		c.Logging = nc.Logging
+		c.logger = newLogger.With("instance", c.Name)
+	}
+	rt, burst := c.Rate, c.Burst
+	c.mu.Unlock()
+	oldHealthCancel()
+	go newBalancer.healthCheck(healthCtx, c.currentLogger(), time.Duration(c.HealthCheck.Interval), time.Duration(c.HealthCheck.Timeout))
+	c.bufSize.Store(int64(c.BufSize))
+	if l := c.limiter.Load(); l != nil {
+		if rt > 0 {
+			l.SetLimit(rate.Limit(rt))
+			l.SetBurst(int(burst))
+		} else {
+			c.limiter.Store(nil)
+		}
+	} else if rt > 0 {
+		c.limiter.Store(rate.NewLimiter(rate.Limit(rt), int(burst)))
+	}
+	c.metrics.setLimits(float64(rt), float64(burst))
+	ls.sync(nc.Addrs, false)
+	c.currentLogger().Info("configuration reloaded")
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+const appName = "rlproxy"
+
+// customHandler, when non-nil, overrides the console handler built
+// from the logging configuration. It is the extension point through
+// which a build-tag-specific file can plug in its own slog.Handler
+// implementation without touching the core logging setup.
+var customHandler func(w io.Writer, level slog.Leveler) slog.Handler
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func loggerFromConfig(conf *loggingConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %v", conf.Level, err)
+	}
+	var handlers []slog.Handler
+	if conf.Console.Enabled {
+		h, err := consoleHandler(&conf.Console, level)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, h)
+	}
+	if conf.Syslog.Enabled {
+		h, err := syslogHandlerFromConfig(&conf.Syslog, level)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, h)
+	}
+	logger := slog.New(fanoutHandler(handlers)).With("app", appName)
+	return logger, nil
+}
+
+func consoleHandler(conf *consoleConfig, level slog.Level) (slog.Handler, error) {
+	out := os.Stdout
+	if conf.UseStderr {
+		out = os.Stderr
+	}
+	if customHandler != nil {
+		return customHandler(out, level), nil
+	}
+	switch conf.Format {
+	case "", "text":
+		color := conf.Color && isatty.IsTerminal(out.Fd())
+		return newTextHandler(out, level, color), nil
+	case "json":
+		return slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level}), nil
+	default:
+		return nil, fmt.Errorf("unknown console log format %q", conf.Format)
+	}
+}
+
+func syslogHandlerFromConfig(conf *syslogConfig, level slog.Level) (slog.Handler, error) {
+	facility, ok := syslogFacilities[conf.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", conf.Facility)
+	}
+	w, err := syslog.New(syslog.LOG_INFO|facility, appName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create syslog logger: %v", err)
+	}
+	switch conf.Format {
+	case "", "cee":
+		return newSyslogHandler(w, level, false), nil
+	case "rfc5424":
+		return newSyslogHandler(w, level, true), nil
+	default:
+		return nil, fmt.Errorf("unknown syslog log format %q", conf.Format)
+	}
+}
+
+// fanoutHandler dispatches every record to all the handlers it wraps,
+// the slog equivalent of zerolog.MultiLevelWriter. An empty fanout
+// discards everything.
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	hs := make(fanoutHandler, len(f))
+	for i, h := range f {
+		hs[i] = h.WithAttrs(attrs)
+	}
+	return hs
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	hs := make(fanoutHandler, len(f))
+	for i, h := range f {
+		hs[i] = h.WithGroup(name)
+	}
+	return hs
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+	ansiGray   = "\x1b[90m"
+)
+
+func levelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return ansiRed
+	case level >= slog.LevelWarn:
+		return ansiYellow
+	case level >= slog.LevelInfo:
+		return ansiCyan
+	default:
+		return ansiGray
+	}
+}
+
+// textHandler is a minimal slog.Handler writing one line of
+// human-readable text per record, with optional ANSI coloring of the
+// level. It plays the role the zerolog console writer used to.
+type textHandler struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  slog.Leveler
+	color  bool
+	attrs  []slog.Attr
+	groups []string
+}
+
+func newTextHandler(w io.Writer, level slog.Leveler, color bool) slog.Handler {
+	return &textHandler{mu: &sync.Mutex{}, out: w, level: level, color: color}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) attrKey(key string) string {
+	if len(h.groups) == 0 {
+		return key
+	}
+	return strings.Join(h.groups, ".") + "." + key
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Time.Format(time.RFC3339))
+	buf.WriteByte(' ')
+	level := r.Level.String()
+	if h.color {
+		level = levelColor(r.Level) + level + ansiReset
+	}
+	buf.WriteString(level)
+	buf.WriteByte(' ')
+	buf.WriteString(r.Message)
+	for _, a := range h.attrs {
+		fmt.Fprintf(&buf, " %s=%v", h.attrKey(a.Key), a.Value.Any())
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&buf, " %s=%v", h.attrKey(a.Key), a.Value.Any())
+		return true
+	})
+	buf.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.out.Write(buf.Bytes())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &nh
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.groups = append(append([]string{}, h.groups...), name)
+	return &nh
+}
+
+// syslogHandler writes one syslog message per record, either as
+// @cee:-prefixed JSON (the CEE convention most syslog/SIEM pipelines
+// already understand) or as RFC 5424 structured data.
+type syslogHandler struct {
+	mu      *sync.Mutex
+	w       *syslog.Writer
+	level   slog.Leveler
+	rfc5424 bool
+	attrs   []slog.Attr
+	groups  []string
+}
+
+func newSyslogHandler(w *syslog.Writer, level slog.Leveler, rfc5424 bool) slog.Handler {
+	return &syslogHandler{mu: &sync.Mutex{}, w: w, level: level, rfc5424: rfc5424}
+}
+
+func (h *syslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *syslogHandler) attrKey(key string) string {
+	if len(h.groups) == 0 {
+		return key
+	}
+	return strings.Join(h.groups, ".") + "." + key
+}
+
+func (h *syslogHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := make(map[string]any, r.NumAttrs()+len(h.attrs))
+	for _, a := range h.attrs {
+		fields[h.attrKey(a.Key)] = a.Value.Any()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fields[h.attrKey(a.Key)] = a.Value.Any()
+		return true
+	})
+	var msg string
+	if h.rfc5424 {
+		var sd strings.Builder
+		sd.WriteString("[rlproxy@0")
+		for k, v := range fields {
+			fmt.Fprintf(&sd, " %s=%q", k, fmt.Sprint(v))
+		}
+		sd.WriteByte(']')
+		msg = fmt.Sprintf("%s %s", sd.String(), r.Message)
+	} else {
+		fields["msg"] = r.Message
+		fields["level"] = r.Level.String()
+		fields["time"] = r.Time.Format(time.RFC3339)
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		msg = "@cee:" + string(b)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &nh
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.groups = append(append([]string{}, h.groups...), name)
+	return &nh
+}